@@ -4,11 +4,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
+// targetNameRe restricts Target.Name to a charset that's safe to splice
+// directly into mountpoint paths (filepath.Join(scratchPath, "roots",
+// t.Name) and friends): no "..", no "/", nothing that could escape the
+// directory it's joined into.
+var targetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
 // An ImageType can be either an ISO or a Zap layer.
 type ImageType string
 
@@ -53,9 +60,49 @@ type Target struct {
 	NSGroup        string       `yaml:"nsgroup"`
 	Mounts         []*MountSpec `yaml:"mounts"`
 	ManifestHash   string       `yaml:"manifest_hash"`
+	Persist        *Persist     `yaml:"persist"`
+	LazyPull       bool         `yaml:"lazy_pull"` // mount against an estargz image without waiting for the full pull
+	PrefetchList   []string     `yaml:"prefetch"`  // paths to fetch eagerly when LazyPull is set
 }
 type InstallTargets []Target
 
+// Persist controls whether a target's writeable overlay (see
+// AtomfsStorage.MountWriteable) survives TearDownTarget/SetupTarget
+// cycles instead of being recreated from scratch on every boot.
+//
+// In YAML it can be given either as a bool:
+//
+//	persist: true
+//
+// or as a string naming the directory under which the upper/work dirs
+// should live:
+//
+//	persist: /var/lib/mos/my-target
+//
+// A bare "true" derives that directory deterministically from the
+// target's name.
+type Persist struct {
+	Enabled bool
+	Path    string
+}
+
+func (p *Persist) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		p.Enabled = enabled
+		return nil
+	}
+
+	var path string
+	if err := unmarshal(&path); err != nil {
+		return fmt.Errorf("persist must be a bool or a path: %w", err)
+	}
+
+	p.Enabled = path != ""
+	p.Path = path
+	return nil
+}
+
 // This describes an install manifest
 type InstallFile struct {
 	Version     int            `yaml:"version"`
@@ -67,6 +114,10 @@ type InstallFile struct {
 	StorageType StorageType    `yaml:"storage_type"`
 	// The original file contents, exactly what was signed
 	original string
+	// Signer is the verified signer identity from the install manifest's
+	// signature, set by NewInstallFile. Empty if MosOptions.AllowUnsigned
+	// let an unsigned file through.
+	Signer string `yaml:"-"`
 }
 
 // SysTarget exists as an intermediary between a 'system manifest'
@@ -79,7 +130,7 @@ type SysTarget struct {
 }
 type SysTargets []SysTarget
 
-func NewInstallFile(p string) (*InstallFile, error) {
+func NewInstallFile(p string, opts MosOptions) (*InstallFile, error) {
 	content, err := ioutil.ReadFile(p)
 	if err != nil {
 		return nil, err
@@ -103,6 +154,18 @@ func NewInstallFile(p string) (*InstallFile, error) {
 		return nil, err
 	}
 
+	// Fails closed: an install manifest with no verifiable signature is
+	// rejected unless the caller explicitly opted into AllowUnsigned.
+	signer, err := verifyInstallFile(p, content, opts)
+	if err != nil {
+		return nil, err
+	}
+	af.Signer = signer
+
+	if err := verifyManifestHashes(af, opts); err != nil {
+		return nil, err
+	}
+
 	// Make all the paths relative to the location of atomix.yaml if
 	// they're relative.
 	if af.Hooks != "" && !filepath.IsAbs(af.Hooks) {
@@ -126,6 +189,10 @@ func (ts InstallTargets) Validate() error {
 			return fmt.Errorf("Target field 'name' cannot be empty: %#v", t)
 		}
 
+		if !targetNameRe.MatchString(t.Name) {
+			return fmt.Errorf("Target name %q contains invalid characters", t.Name)
+		}
+
 		if t.Version == "" {
 			return fmt.Errorf("Target %s cannot have empty version", t.Name)
 		}
@@ -0,0 +1,62 @@
+package mosconfig
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestInstallTargetsValidateRejectsBadNames(t *testing.T) {
+	cases := []struct {
+		name    string
+		target  Target
+		wantErr bool
+	}{
+		{"valid", Target{SourceLayer: "foo:bar", Name: "my-target", Version: "1"}, false},
+		{"empty name", Target{SourceLayer: "foo:bar", Name: "", Version: "1"}, true},
+		{"path traversal", Target{SourceLayer: "foo:bar", Name: "../etc", Version: "1"}, true},
+		{"embedded slash", Target{SourceLayer: "foo:bar", Name: "a/b", Version: "1"}, true},
+		{"empty version", Target{SourceLayer: "foo:bar", Name: "my-target", Version: ""}, true},
+		{"bad source layer", Target{SourceLayer: "noseparator", Name: "my-target", Version: "1"}, true},
+	}
+
+	for _, c := range cases {
+		err := InstallTargets{c.target}.Validate()
+		if c.wantErr && err == nil {
+			t.Errorf("%s: expected an error, got nil", c.name)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+}
+
+func TestPersistUnmarshalYAMLBool(t *testing.T) {
+	var p Persist
+	if err := yaml.Unmarshal([]byte("true"), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !p.Enabled || p.Path != "" {
+		t.Errorf("got %+v, want Enabled=true Path=\"\"", p)
+	}
+}
+
+func TestPersistUnmarshalYAMLPath(t *testing.T) {
+	var p Persist
+	if err := yaml.Unmarshal([]byte("/var/lib/mos/my-target"), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !p.Enabled || p.Path != "/var/lib/mos/my-target" {
+		t.Errorf("got %+v, want Enabled=true Path=/var/lib/mos/my-target", p)
+	}
+}
+
+func TestPersistUnmarshalYAMLFalse(t *testing.T) {
+	var p Persist
+	if err := yaml.Unmarshal([]byte("false"), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if p.Enabled {
+		t.Errorf("got %+v, want Enabled=false", p)
+	}
+}
@@ -0,0 +1,312 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// layerBlobDigest resolves t's single image layer to its sha256 digest,
+// reusing ociManifestDigest (see verify.go) to turn the tag into a manifest
+// digest. The manifest itself is still read off zot's local on-disk layout
+// (it's a few hundred bytes of JSON, not the layer payload lazy pull exists
+// to avoid pre-staging) -- only the layer blob this resolves to is fetched
+// remotely, by openRemoteEstargz.
+func layerBlobDigest(ociDir, tag string) (string, error) {
+	manifestDigest, err := ociManifestDigest(ociDir, tag)
+	if err != nil {
+		return "", fmt.Errorf("Failed resolving manifest digest for tag %q: %w", tag, err)
+	}
+
+	manifestPath := filepath.Join(ociDir, "blobs", "sha256", manifestDigest)
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed reading manifest %q: %w", manifestPath, err)
+	}
+
+	var manifest struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("Failed parsing manifest %q: %w", manifestPath, err)
+	}
+	if len(manifest.Layers) != 1 {
+		return "", fmt.Errorf("lazy pull only supports single-layer images, manifest %q has %d layers", manifestPath, len(manifest.Layers))
+	}
+
+	digest := strings.TrimPrefix(manifest.Layers[0].Digest, "sha256:")
+	if digest == "" {
+		return "", fmt.Errorf("layer manifest %q has an empty digest", manifestPath)
+	}
+
+	return digest, nil
+}
+
+// registryBlobURL builds the OCI Distribution API URL for a content-addressed
+// blob in repo, per the spec's GET /v2/<name>/blobs/<digest> endpoint that
+// zot (and any other registry) serves.
+func registryBlobURL(registryURL, repo, digest string) string {
+	return strings.TrimSuffix(registryURL, "/") + "/v2/" + repo + "/blobs/sha256:" + digest
+}
+
+// httpRangeReaderAt is an io.ReaderAt that satisfies each ReadAt by issuing
+// an HTTP Range request against url, so estargz.Reader -- which only ever
+// reads the TOC footer and individual chunks it's asked for, never the
+// whole blob -- can pull a layer's bytes straight off the registry on
+// demand instead of requiring them staged to a local file first.
+type httpRangeReaderAt struct {
+	client *http.Client
+	url    string
+}
+
+func (h *httpRangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed building range request for %q: %w", h.url, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Failed fetching %q: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %q: unexpected status %s", h.url, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return n, fmt.Errorf("Failed reading range response from %q: %w", h.url, err)
+	}
+	return n, nil
+}
+
+// registryBlobSize HEADs url to learn its Content-Length, which is how
+// openRemoteEstargz bounds the io.SectionReader it hands to estargz.Open --
+// estargz needs a fixed size to seek to the TOC footer at the end of the
+// blob without reading everything in front of it.
+func registryBlobSize(client *http.Client, url string) (int64, error) {
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, fmt.Errorf("Failed HEAD %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD %q: unexpected status %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("HEAD %q: registry did not report a Content-Length", url)
+	}
+	return resp.ContentLength, nil
+}
+
+// openRemoteEstargz opens url as an estargz-formatted layer served by an
+// OCI-Distribution-compatible registry, fetching only the TOC footer and
+// individual chunks over HTTP Range requests rather than requiring the
+// whole layer already present on disk.
+func openRemoteEstargz(client *http.Client, url string) (*estargz.Reader, error) {
+	size, err := registryBlobSize(client, url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed sizing remote layer %q: %w", url, err)
+	}
+
+	ra := &httpRangeReaderAt{client: client, url: url}
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing estargz TOC for %q: %w", url, err)
+	}
+
+	return r, nil
+}
+
+// extractEstargzEntry materializes a single TOCEntry under destRoot.
+func extractEstargzEntry(r *estargz.Reader, ent *estargz.TOCEntry, destRoot string) error {
+	dest := filepath.Join(destRoot, ent.Name)
+
+	switch ent.Type {
+	case "dir":
+		return EnsureDir(dest)
+	case "symlink":
+		if err := EnsureDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		if err := os.Symlink(ent.LinkName, dest); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Failed symlinking %q: %w", dest, err)
+		}
+		return nil
+	case "hardlink":
+		if err := EnsureDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(destRoot, ent.LinkName), dest); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Failed hardlinking %q: %w", dest, err)
+		}
+		return nil
+	case "reg":
+		if err := EnsureDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		src, err := r.OpenFile(ent.Name)
+		if err != nil {
+			return fmt.Errorf("Failed opening %q in layer: %w", ent.Name, err)
+		}
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(ent.Mode))
+		if err != nil {
+			return fmt.Errorf("Failed creating %q: %w", dest, err)
+		}
+		defer out.Close()
+		if _, err := io.Copy(out, src); err != nil {
+			return fmt.Errorf("Failed extracting %q: %w", ent.Name, err)
+		}
+		return nil
+	case "char", "block", "fifo":
+		// Device/fifo nodes need root and CAP_MKNOD to create; rather
+		// than fail the whole mount over one, skip it and log -- targets
+		// that need real device nodes in their rootfs aren't good
+		// candidates for lazy pull in the first place.
+		log.Warnf("lazy pull: skipping device/fifo entry %q", ent.Name)
+		return nil
+	default:
+		return nil
+	}
+}
+
+// extractEstargzTree extracts ent under destRoot and, if ent is a
+// directory, recursively everything beneath it.
+func extractEstargzTree(r *estargz.Reader, ent *estargz.TOCEntry, destRoot string) error {
+	if err := extractEstargzEntry(r, ent, destRoot); err != nil {
+		return err
+	}
+	if ent.Type != "dir" {
+		return nil
+	}
+
+	var childErr error
+	ent.ForeachChild(func(_ string, child *estargz.TOCEntry) bool {
+		if err := extractEstargzTree(r, child, destRoot); err != nil {
+			childErr = err
+			return false
+		}
+		return true
+	})
+	return childErr
+}
+
+// extractEstargzPrioritized extracts prefetch's paths (and everything
+// beneath them, for directories) first, then the rest of the layer. This
+// is the "prioritized fetch" estargz enables: the paths a target is known
+// to need immediately are ready before extraction of the whole layer
+// completes.
+//
+// This package has no background-paging runtime to hand a still-extracting
+// mount off to, so unlike a FUSE-backed lazy-pull filesystem, extraction
+// here is synchronous: Mount doesn't return until the full layer is on
+// disk. What lazy pull buys in this implementation is solely in not
+// requiring the whole layer to be pulled to zotPath up front -- Mount reads
+// it chunk-by-chunk, in prefetch-first order, straight out of the estargz
+// blob.
+func extractEstargzPrioritized(r *estargz.Reader, prefetch []string, destRoot string) error {
+	extracted := map[string]bool{}
+
+	var extractPath func(path string) error
+	extractPath = func(path string) error {
+		if extracted[path] {
+			return nil
+		}
+		ent, ok := r.Lookup(path)
+		if !ok {
+			return fmt.Errorf("prefetch path %q not found in layer", path)
+		}
+		if err := extractEstargzTree(r, ent, destRoot); err != nil {
+			return err
+		}
+		extracted[path] = true
+		return nil
+	}
+
+	for _, path := range prefetch {
+		if err := extractPath(path); err != nil {
+			return fmt.Errorf("Failed prefetching %q: %w", path, err)
+		}
+	}
+
+	root, ok := r.Lookup("")
+	if !ok {
+		return fmt.Errorf("layer has no root entry")
+	}
+	var walkErr error
+	root.ForeachChild(func(baseName string, child *estargz.TOCEntry) bool {
+		if extracted[child.Name] {
+			return true
+		}
+		if err := extractEstargzTree(r, child, destRoot); err != nil {
+			walkErr = err
+			return false
+		}
+		return true
+	})
+	return walkErr
+}
+
+// mountLazy is AtomfsStorage's LazyPull mount path: rather than requiring
+// t's full layer already be pulled to zotPath, it range-fetches the layer
+// blob straight from the registry at a.registryURL, reading only its estargz
+// TOC and the chunks extraction actually touches (PrefetchList first), and
+// extracts them into scratchPath/atomfs-lazy/<digest>. That extraction
+// directory is then mounted on mountpoint as the sole lowerdir of a
+// readonly overlay, so getHashFromOverlay keeps finding a digest-named
+// lowerdir the same way it does for a normal atomfs mount.
+func (a *AtomfsStorage) mountLazy(t *Target, mountpoint string) (func(), error) {
+	if a.registryURL == "" {
+		return func() {}, fmt.Errorf("lazy pull requested for target %q but no registry URL is configured", t.Name)
+	}
+
+	ociDir := filepath.Join(a.zotPath, t.Fullname)
+	digest, err := layerBlobDigest(ociDir, t.Version)
+	if err != nil {
+		return func() {}, fmt.Errorf("Failed resolving lazy-pull layer for %#v: %w", t, err)
+	}
+
+	url := registryBlobURL(a.registryURL, t.Fullname, digest)
+	r, err := openRemoteEstargz(http.DefaultClient, url)
+	if err != nil {
+		return func() {}, fmt.Errorf("Failed opening remote layer %q: %w", url, err)
+	}
+
+	extractDir := filepath.Join(a.scratchPath, "atomfs-lazy", digest)
+	if err := EnsureDir(extractDir); err != nil {
+		return func() {}, fmt.Errorf("Failed creating lazy-pull extraction dir %q: %w", extractDir, err)
+	}
+
+	if err := extractEstargzPrioritized(r, t.PrefetchList, extractDir); err != nil {
+		os.RemoveAll(extractDir)
+		return func() {}, fmt.Errorf("Failed extracting estargz layer %q: %w", url, err)
+	}
+
+	if err := EnsureDir(mountpoint); err != nil {
+		return func() {}, fmt.Errorf("Failed creating mountpoint %q: %w", mountpoint, err)
+	}
+
+	if err := safeMount(a.scratchPath, mountpoint, "overlayfs", "overlay", 0, fmt.Sprintf("lowerdir=%s", extractDir)); err != nil {
+		return func() {}, fmt.Errorf("Failed mounting lazy-pulled layer %q to %q: %w", extractDir, mountpoint, err)
+	}
+
+	cleanup := func() {
+		if err := safeUnmount(a.scratchPath, mountpoint, 0); err != nil {
+			log.Warnf("unmounting %s failed: %s", mountpoint, err)
+		}
+	}
+	return cleanup, nil
+}
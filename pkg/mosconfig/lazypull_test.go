@@ -0,0 +1,168 @@
+package mosconfig
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildTestLayer writes a minimal estargz layer containing the given files
+// under ociDir/blobs/sha256, and an index.json + manifest referencing it
+// under the tag "latest", mirroring the local OCI layout layerBlobDigest and
+// ociManifestDigest expect.
+func buildTestLayer(t *testing.T, ociDir string, files map[string]string) string {
+	t.Helper()
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%s): %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Write(%s): %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+
+	var layerBuf bytes.Buffer
+	w := estargz.NewWriter(&layerBuf)
+	if err := w.AppendTar(bytes.NewReader(tarBuf.Bytes())); err != nil {
+		t.Fatalf("AppendTar: %v", err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatalf("estargz Writer.Close: %v", err)
+	}
+
+	layerDigest := "sha256:" + sha256Hex(layerBuf.Bytes())
+	blobsDir := filepath.Join(ociDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	layerHash := layerDigest[len("sha256:"):]
+	if err := os.WriteFile(filepath.Join(blobsDir, layerHash), layerBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := map[string]any{
+		"layers": []map[string]string{{"digest": layerDigest}},
+	}
+	manifestContent, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestHash := sha256Hex(manifestContent)
+	if err := os.WriteFile(filepath.Join(blobsDir, manifestHash), manifestContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index := ociIndex{
+		Manifests: []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		}{
+			{
+				Digest:      "sha256:" + manifestHash,
+				Annotations: map[string]string{"org.opencontainers.image.ref.name": "latest"},
+			},
+		},
+	}
+	indexContent, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ociDir, "index.json"), indexContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return layerHash
+}
+
+func TestLayerBlobDigestResolvesToLayerDigest(t *testing.T) {
+	ociDir := t.TempDir()
+	wantHash := buildTestLayer(t, ociDir, map[string]string{"hello.txt": "hi"})
+
+	digest, err := layerBlobDigest(ociDir, "latest")
+	if err != nil {
+		t.Fatalf("layerBlobDigest: %v", err)
+	}
+
+	if digest != wantHash {
+		t.Errorf("digest = %q, want %q", digest, wantHash)
+	}
+}
+
+// rangeServer spins up an httptest.Server that serves content at
+// /v2/<repo>/blobs/sha256:<digest>, honoring Range requests and HEAD the
+// same way a real OCI Distribution registry (e.g. zot) would -- so
+// httpRangeReaderAt/registryBlobSize can be exercised without a real
+// registry.
+func rangeServer(t *testing.T, content []byte) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestOpenRemoteEstargzFetchesOverRange(t *testing.T) {
+	ociDir := t.TempDir()
+	digest := buildTestLayer(t, ociDir, map[string]string{
+		"a.txt":     "aaa",
+		"b.txt":     "bbb",
+		"dir/c.txt": "ccc",
+	})
+	blobContent, err := os.ReadFile(filepath.Join(ociDir, "blobs", "sha256", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rangeServer(t, blobContent)
+	defer srv.Close()
+
+	r, err := openRemoteEstargz(srv.Client(), srv.URL+"/v2/myrepo/blobs/sha256:"+digest)
+	if err != nil {
+		t.Fatalf("openRemoteEstargz: %v", err)
+	}
+
+	destRoot := t.TempDir()
+	if err := extractEstargzPrioritized(r, []string{"a.txt"}, destRoot); err != nil {
+		t.Fatalf("extractEstargzPrioritized: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"a.txt":     "aaa",
+		"b.txt":     "bbb",
+		"dir/c.txt": "ccc",
+	} {
+		got, err := os.ReadFile(filepath.Join(destRoot, name))
+		if err != nil {
+			t.Errorf("reading extracted %q: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%q = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+)
+
+// mountWriteableOverlay is the shared "readonly mount + writeable overlay
+// on top" trick every Storage backend uses for container targets (see
+// setupOverlayTarget): a throwaway readonly mount from roMount, topped
+// with an overlay whose upper/work dirs are either scratch temp dirs or,
+// per Target.Persist, a stable location that survives teardown. It's
+// factored out so things like chunk0-4's mount hardening or chunk0-2's
+// persistence only need to be gotten right once, rather than once per
+// backend.
+func mountWriteableOverlay(scratchPath string, t *Target, mountpoint string, roMount func(t *Target, mountpoint string) (func(), error)) (func(), error) {
+	ropath, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.Name))
+	if err != nil {
+		return func() {}, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
+	}
+
+	roCleanup, err := roMount(t, ropath)
+	if err != nil {
+		os.Remove(ropath)
+		return func() {}, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
+	}
+
+	persist := t.Persist != nil && t.Persist.Enabled
+
+	var workdir, upperdir string
+	if persist {
+		upperdir, workdir, err = persistentDirs(scratchPath, t)
+		if err != nil {
+			roCleanup()
+			os.Remove(ropath)
+			return func() {}, err
+		}
+	} else {
+		workdir, err = os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.Name))
+		if err != nil {
+			roCleanup()
+			os.Remove(ropath)
+			return func() {}, fmt.Errorf("Failed creating workdir: %w", err)
+		}
+
+		upperdir, err = os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.Name))
+		if err != nil {
+			roCleanup()
+			os.Remove(ropath)
+			os.RemoveAll(workdir)
+			return func() {}, fmt.Errorf("Failed creating upperdir: %w", err)
+		}
+	}
+
+	overlayArgs := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", ropath, upperdir, workdir)
+	err = safeMount(scratchPath, mountpoint, "overlayfs", "overlay", 0, overlayArgs)
+	if err != nil {
+		roCleanup()
+		if !persist {
+			os.RemoveAll(workdir)
+			os.RemoveAll(upperdir)
+		}
+		os.Remove(ropath)
+		return func() {}, fmt.Errorf("Failed mounting writeable overlay: %w", err)
+	}
+
+	cleanup := func() {
+		safeUnmount(scratchPath, mountpoint, 0)
+		roCleanup()
+		if !persist {
+			os.RemoveAll(workdir)
+			os.RemoveAll(upperdir)
+		}
+		os.Remove(ropath)
+	}
+
+	return cleanup, nil
+}
+
+// setupOverlayTarget is the shared SetupTarget body for every backend:
+// tear down any stale mount at scratchPath/roots/t.Name, recreate the
+// mountpoint, then hand off to mount (non-container targets) or
+// mountContainer (container targets, which may itself be a fallback
+// chain -- see AtomfsStorage.mountContainer).
+func setupOverlayTarget(scratchPath string, t *Target, mount, mountContainer func(t *Target, mountpoint string) (func(), error)) error {
+	mp := filepath.Join(scratchPath, "roots", t.Name)
+	mounted, err := IsMountpoint(mp)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	}
+	if mounted {
+		if err := safeUnmount(scratchPath, mp, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := EnsureDir(mp); err != nil {
+		return fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
+	}
+
+	if t.ServiceType == "container" {
+		_, err = mountContainer(t, mp)
+	} else {
+		_, err = mount(t, mp)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed mounting %s:%s to %q: %w", t.Name, t.Version, mp, err)
+	}
+
+	return nil
+}
+
+// targetMountdir is the shared TargetMountdir body: we mount a readonly
+// copy of the fs under $scratch-writes/roots/$target. A container
+// service will want to set lxc.rootfs.path = that, while an fs-only
+// service will simply want to do an overlay rw mount onto
+// /mnt/atom/$target.
+func targetMountdir(scratchPath string, t *Target) (string, error) {
+	return filepath.Join(scratchPath, "roots", t.Name), nil
+}
+
+// tearDownOverlayTarget is the shared TearDownTarget body: unmount
+// scratchPath/roots/name if it's mounted, via umount (both backends pass
+// a wrapper around safeUnmount).
+func tearDownOverlayTarget(scratchPath, name, label string, umount func(mp string) error) error {
+	log.Warnf("tearing down %q", name)
+	mp := filepath.Join(scratchPath, "roots", name)
+	mounted, err := IsMountpoint(mp)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	}
+	if !mounted {
+		return nil
+	}
+
+	if err := umount(mp); err != nil {
+		return fmt.Errorf("%s umount of %q failed: %w", label, mp, err)
+	}
+	return nil
+}
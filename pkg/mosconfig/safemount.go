@@ -0,0 +1,115 @@
+package mosconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// safeHandle is an open, non-symlink-following handle to a path beneath a
+// trusted root directory. It closes the TOCTOU window between validating
+// a mountpoint (IsMountpoint) and acting on it (mount(2)/umount(2)): if a
+// path component is swapped for a symlink in between, the fd still refers
+// to whatever actually got resolved, not wherever the symlink now points.
+// This is the same class of attack as CVE-2021-30465.
+type safeHandle struct {
+	fd int
+	// path is the /proc/self/fd magic link for fd, safe to hand to
+	// mount(2)/umount(2) in place of the caller-supplied string path.
+	path string
+}
+
+func (h *safeHandle) Close() error {
+	return unix.Close(h.fd)
+}
+
+// openSafe opens target for use as a mount(2)/umount(2) argument,
+// refusing to follow any symlink along the way and refusing to resolve
+// outside of root. It prefers openat2(RESOLVE_NO_SYMLINKS|RESOLVE_BENEATH)
+// where the kernel supports it, falling back to O_NOFOLLOW plus an
+// explicit prefix check against the /proc/self/fd magic link otherwise.
+func openSafe(root, target string) (*safeHandle, error) {
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening root %q: %w", root, err)
+	}
+	defer unix.Close(rootFd)
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed computing %q relative to %q: %w", target, root, err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("refusing to operate on %q: escapes %q", target, root)
+	}
+
+	fd, err := unix.Openat2(rootFd, rel, &unix.OpenHow{
+		Flags:   unix.O_PATH,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_BENEATH,
+	})
+	if err != nil {
+		if !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EINVAL) {
+			// openat2 understood the request and refused it -- most
+			// likely because rel traverses a symlink, exactly what
+			// RESOLVE_NO_SYMLINKS exists to block. Don't retry with the
+			// weaker O_NOFOLLOW fallback below: its /proc/self/fd magic
+			// link check can't tell a symlink swapped in for a
+			// non-final path component from a plain directory, since
+			// O_NOFOLLOW only ever inspects the final component.
+			return nil, fmt.Errorf("Failed opening %q safely: %w", target, err)
+		}
+		// openat2, or these resolve flags, aren't supported on this
+		// kernel; fall back to a plain O_NOFOLLOW open and verify the
+		// result by hand below.
+		fd, err = unix.Openat(rootFd, rel, unix.O_PATH|unix.O_NOFOLLOW, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Failed opening %q safely: %w", target, err)
+		}
+	}
+
+	magicPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	resolved, err := os.Readlink(magicPath)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed resolving %q: %w", magicPath, err)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed resolving root %q: %w", root, err)
+	}
+	if resolved != realRoot && !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+		unix.Close(fd)
+		return nil, fmt.Errorf("refusing to operate on %q: resolved to %q, outside %q", target, resolved, realRoot)
+	}
+
+	return &safeHandle{fd: fd, path: magicPath}, nil
+}
+
+// safeMount mounts against a path opened with openSafe rather than the
+// caller-supplied string directly.
+func safeMount(root, target, source, fstype string, flags uintptr, data string) error {
+	h, err := openSafe(root, target)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return unix.Mount(source, h.path, fstype, flags, data)
+}
+
+// safeUnmount is the umount(2) counterpart to safeMount.
+func safeUnmount(root, target string, flags int) error {
+	h, err := openSafe(root, target)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return unix.Unmount(h.path, flags)
+}
@@ -0,0 +1,69 @@
+package mosconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenSafeAllowsPlainDirectory(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "mnt")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openSafe(root, target)
+	if err != nil {
+		t.Fatalf("openSafe: %v", err)
+	}
+	defer h.Close()
+}
+
+func TestOpenSafeRejectsSymlinkEscapingRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	escape := filepath.Join(root, "escape")
+	if err := os.Symlink(outside, escape); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openSafe(root, escape); err == nil {
+		t.Error("openSafe followed a symlink escaping root")
+	}
+}
+
+// TestOpenSafeRejectsSwappedPathComponent simulates the CVE-2021-30465
+// class of TOCTOU attack safeHandle exists to close: a path component
+// that was a real directory is swapped for a symlink out of root in
+// between some earlier validation and the mount/umount call. openSafe
+// itself must refuse such a path outright, rather than relying on the
+// caller to have re-checked it just before acting.
+func TestOpenSafeRejectsSwappedPathComponent(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	target := filepath.Join(root, "mnt")
+
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := openSafe(root, target); err != nil {
+		t.Fatalf("openSafe on the original directory: %v", err)
+	} else {
+		h.Close()
+	}
+
+	// An attacker swaps the real directory out for a symlink pointing
+	// outside root.
+	if err := os.Remove(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, target); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openSafe(root, target); err == nil {
+		t.Error("openSafe followed a path component swapped for a symlink")
+	}
+}
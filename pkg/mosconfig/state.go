@@ -0,0 +1,422 @@
+package mosconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	systemStateDir     = "var/lib/mos"
+	systemStateFile    = "state.yaml"
+	systemStateHistory = "history"
+)
+
+// SystemStateRecoveryPath is a fixed location outside of RootDir, so the
+// most recently written state.yaml stays discoverable no matter which
+// root ends up booted.
+const SystemStateRecoveryPath = "/var/lib/mos-recovery/state.yaml"
+
+// stateSigningKeyPath holds the ECDSA key WriteSystemState signs state.yaml
+// with and ReadSystemState verifies it against. It lives outside RootDir,
+// alongside SystemStateRecoveryPath, for the same reason: anyone who can
+// write RootDir's state.yaml to rewrite history must not also be able to
+// reach the key that makes a rewritten copy verify.
+//
+// A var rather than a const so tests can point it at a scratch directory
+// instead of the real machine-wide path.
+var stateSigningKeyPath = "/var/lib/mos-recovery/state-signing.key"
+
+// StateTarget records everything about an active Target that SetupTarget
+// needs to re-create it later, notably during Rollback: not just enough to
+// identify it, but its full configuration, so a rollback reconstructs the
+// exact same mount (service type, nsgroup, extra mounts, persistence,
+// lazy-pull settings) rather than a stripped-down stand-in for it.
+type StateTarget struct {
+	Name         string       `yaml:"name"`
+	Fullname     string       `yaml:"fullname"`
+	Version      string       `yaml:"version"`
+	ManifestHash string       `yaml:"manifest_hash"`
+	ServiceType  string       `yaml:"service_type"`
+	NSGroup      string       `yaml:"nsgroup"`
+	Mounts       []*MountSpec `yaml:"mounts"`
+	Persist      *Persist     `yaml:"persist"`
+	LazyPull     bool         `yaml:"lazy_pull"`
+	PrefetchList []string     `yaml:"prefetch"`
+}
+
+// SystemState is what gets written to state.yaml every time an
+// InstallFile is applied. Each one records the hash of the state it
+// replaced, forming a chain that Rollback follows one step back. The whole
+// record is itself signed (see signState/verifyStateSignature) with a
+// machine-local key kept outside RootDir, so that chain can't be rewritten
+// by anyone who can merely write files under RootDir.
+type SystemState struct {
+	Product      string        `yaml:"product"`
+	Version      int           `yaml:"version"`
+	ImageType    ImageType     `yaml:"image_type"`
+	UpdateType   UpdateType    `yaml:"update_type"`
+	StorageType  StorageType   `yaml:"storage_type"`
+	Targets      []StateTarget `yaml:"targets"`
+	Timestamp    time.Time     `yaml:"timestamp"`
+	PreviousHash string        `yaml:"previous_hash,omitempty"`
+	// Signer is the verified signer identity of the InstallFile that
+	// produced this state (see verifyInstallFile), empty if it was
+	// installed unsigned.
+	Signer string `yaml:"signer,omitempty"`
+	// Signature is a base64-encoded ECDSA signature over this state with
+	// Signature itself left empty, made with the key at
+	// stateSigningKeyPath. Set by signState, checked by
+	// verifyStateSignature.
+	Signature string `yaml:"signature,omitempty"`
+}
+
+func newSystemState(af *InstallFile, targets SysTargets, previousHash string) *SystemState {
+	sTargets := make([]StateTarget, 0, len(targets))
+	for _, st := range targets {
+		stateTarget := StateTarget{
+			Name:     st.Name,
+			Fullname: st.Source,
+		}
+		if st.raw != nil {
+			if st.raw.Fullname != "" {
+				stateTarget.Fullname = st.raw.Fullname
+			}
+			stateTarget.Version = st.raw.Version
+			stateTarget.ManifestHash = st.raw.ManifestHash
+			stateTarget.ServiceType = st.raw.ServiceType
+			stateTarget.NSGroup = st.raw.NSGroup
+			stateTarget.Mounts = st.raw.Mounts
+			stateTarget.Persist = st.raw.Persist
+			stateTarget.LazyPull = st.raw.LazyPull
+			stateTarget.PrefetchList = st.raw.PrefetchList
+		}
+		sTargets = append(sTargets, stateTarget)
+	}
+
+	return &SystemState{
+		Product:      af.Product,
+		Version:      af.Version,
+		ImageType:    af.ImageType,
+		UpdateType:   af.UpdateType,
+		StorageType:  af.StorageType,
+		Targets:      sTargets,
+		Timestamp:    time.Now().UTC(),
+		PreviousHash: previousHash,
+		Signer:       af.Signer,
+	}
+}
+
+func (s *SystemState) hash() (string, error) {
+	content, err := yaml.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("Failed marshalling state for hashing: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// stateSigningDigest hashes s the same way signState and
+// verifyStateSignature both need to: with Signature itself cleared, since
+// it can't be part of what it signs.
+func stateSigningDigest(s *SystemState) ([32]byte, error) {
+	unsigned := *s
+	unsigned.Signature = ""
+	content, err := yaml.Marshal(&unsigned)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("Failed marshalling state for signing: %w", err)
+	}
+	return sha256.Sum256(content), nil
+}
+
+// signState produces a base64-encoded ECDSA signature over s (with
+// Signature left empty) under key, suitable for SystemState.Signature.
+func signState(s *SystemState, key *ecdsa.PrivateKey) (string, error) {
+	digest, err := stateSigningDigest(s)
+	if err != nil {
+		return "", err
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Failed signing state: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyStateSignature checks s.Signature against pub, failing if it's
+// missing, malformed, or doesn't match.
+func verifyStateSignature(s *SystemState, pub *ecdsa.PublicKey) error {
+	if s.Signature == "" {
+		return fmt.Errorf("state has no signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return fmt.Errorf("Failed decoding state signature: %w", err)
+	}
+	digest, err := stateSigningDigest(s)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return fmt.Errorf("state signature verification failed")
+	}
+	return nil
+}
+
+// loadOrCreateStateSigningKey loads the ECDSA key at path, generating and
+// persisting a new P-256 one on first use. Keeping this key stable across
+// calls (rather than generating one per process) is what lets
+// ReadSystemState verify signatures signState made in an earlier process.
+func loadOrCreateStateSigningKey(path string) (*ecdsa.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("Failed decoding PEM in state signing key %q", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing state signing key %q: %w", path, err)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed reading state signing key %q: %w", path, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed generating state signing key: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed marshalling state signing key: %w", err)
+	}
+	pemContent := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("Failed creating state signing key dir: %w", err)
+	}
+	if err := os.WriteFile(path, pemContent, 0600); err != nil {
+		return nil, fmt.Errorf("Failed writing state signing key %q: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func systemStatePath(rootDir string) string {
+	return filepath.Join(rootDir, systemStateDir, systemStateFile)
+}
+
+func systemStateHistoryPath(rootDir, hash string) string {
+	return filepath.Join(rootDir, systemStateDir, systemStateHistory, hash+".yaml")
+}
+
+// archiveSystemState saves a copy of a state under its own content hash,
+// so a later rollback can find the targets it activated.
+func archiveSystemState(rootDir string, s *SystemState, hash string) error {
+	path := systemStateHistoryPath(rootDir, hash)
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Failed creating state history dir: %w", err)
+	}
+
+	content, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling state %s: %w", hash, err)
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Failed archiving state %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+// WriteSystemState records the InstallFile and resolved targets that were
+// just activated as the new state.yaml, chaining it to whatever state was
+// previously active and signing the result with stateSigningKeyPath. It's
+// called on every full or partial install so there's always a signed,
+// machine-readable audit trail of what's running and how it got there.
+func WriteSystemState(rootDir string, af *InstallFile, targets SysTargets) error {
+	prevHash := ""
+	prev, err := ReadSystemState(systemStatePath(rootDir))
+	if err == nil {
+		prevHash, err = prev.hash()
+		if err != nil {
+			return err
+		}
+		if err := archiveSystemState(rootDir, prev, prevHash); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Failed reading existing state: %w", err)
+	}
+
+	state := newSystemState(af, targets, prevHash)
+
+	key, err := loadOrCreateStateSigningKey(stateSigningKeyPath)
+	if err != nil {
+		return fmt.Errorf("Failed loading state signing key: %w", err)
+	}
+	sig, err := signState(state, key)
+	if err != nil {
+		return err
+	}
+	state.Signature = sig
+
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling state: %w", err)
+	}
+
+	path := systemStatePath(rootDir)
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Failed creating state dir %q: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing state %q: %w", path, err)
+	}
+
+	if err := EnsureDir(filepath.Dir(SystemStateRecoveryPath)); err != nil {
+		return fmt.Errorf("Failed creating recovery state dir: %w", err)
+	}
+	if err := os.WriteFile(SystemStateRecoveryPath, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing recovery state %q: %w", SystemStateRecoveryPath, err)
+	}
+
+	return nil
+}
+
+// ReadSystemState loads a state.yaml from an arbitrary path, used for both
+// the currently active state and archived history entries, and verifies
+// its signature against stateSigningKeyPath before returning it.
+func ReadSystemState(path string) (*SystemState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SystemState{}
+	if err := yaml.Unmarshal(content, s); err != nil {
+		return nil, fmt.Errorf("Failed parsing state %q: %w", path, err)
+	}
+
+	key, err := loadOrCreateStateSigningKey(stateSigningKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading state signing key: %w", err)
+	}
+	if err := verifyStateSignature(s, &key.PublicKey); err != nil {
+		return nil, fmt.Errorf("Failed verifying state %q: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// CurrentSystemState reads the active state.yaml for rootDir, falling
+// back to the recovery copy if the primary is missing, e.g. because
+// we've booted a root that never itself wrote one.
+func CurrentSystemState(rootDir string) (*SystemState, error) {
+	s, err := ReadSystemState(systemStatePath(rootDir))
+	if err == nil {
+		return s, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return ReadSystemState(SystemStateRecoveryPath)
+}
+
+// Rollback re-activates the targets recorded in the state previous to the
+// currently active one, re-running SetupTarget for each via s, then writes
+// a new state.yaml so the rollback itself shows up in the audit trail.
+//
+// This is a library entry point only -- no "mos rollback" subcommand calls
+// it yet, since this tree has no cmd/ package. An operator can't invoke
+// this today short of calling it from a Go program of their own; whatever
+// wires up mos's CLI will need to add one.
+func Rollback(rootDir string, s Storage) error {
+	cur, err := CurrentSystemState(rootDir)
+	if err != nil {
+		return fmt.Errorf("Failed reading current state: %w", err)
+	}
+
+	if cur.PreviousHash == "" {
+		return fmt.Errorf("no prior state to roll back to")
+	}
+
+	prev, err := ReadSystemState(systemStateHistoryPath(rootDir, cur.PreviousHash))
+	if err != nil {
+		return fmt.Errorf("Failed reading state %s: %w", cur.PreviousHash, err)
+	}
+
+	for _, st := range prev.Targets {
+		t := &Target{
+			Name:         st.Name,
+			Fullname:     st.Fullname,
+			Version:      st.Version,
+			ManifestHash: st.ManifestHash,
+			ServiceType:  st.ServiceType,
+			NSGroup:      st.NSGroup,
+			Mounts:       st.Mounts,
+			Persist:      st.Persist,
+			LazyPull:     st.LazyPull,
+			PrefetchList: st.PrefetchList,
+		}
+		if err := s.SetupTarget(t); err != nil {
+			return fmt.Errorf("Failed re-activating target %q during rollback: %w", st.Name, err)
+		}
+	}
+
+	curHash, err := cur.hash()
+	if err != nil {
+		return err
+	}
+	if err := archiveSystemState(rootDir, cur, curHash); err != nil {
+		return err
+	}
+
+	rolledBack := *prev
+	rolledBack.Timestamp = time.Now().UTC()
+	rolledBack.PreviousHash = curHash
+
+	// prev's Signature covered its own Timestamp/PreviousHash, both of
+	// which just changed, so it no longer verifies against rolledBack's
+	// actual content -- it must be re-signed, not carried over.
+	key, err := loadOrCreateStateSigningKey(stateSigningKeyPath)
+	if err != nil {
+		return fmt.Errorf("Failed loading state signing key: %w", err)
+	}
+	sig, err := signState(&rolledBack, key)
+	if err != nil {
+		return err
+	}
+	rolledBack.Signature = sig
+
+	content, err := yaml.Marshal(&rolledBack)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling rolled-back state: %w", err)
+	}
+
+	path := systemStatePath(rootDir)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing state %q: %w", path, err)
+	}
+	if err := os.WriteFile(SystemStateRecoveryPath, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing recovery state %q: %w", SystemStateRecoveryPath, err)
+	}
+
+	return nil
+}
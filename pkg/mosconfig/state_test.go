@@ -0,0 +1,156 @@
+package mosconfig
+
+import (
+	"os"
+	"testing"
+)
+
+// withTestStateSigningKey points stateSigningKeyPath at a scratch file for
+// the duration of the test, so signing doesn't touch the real machine-wide
+// key, and removes any real recovery state.yaml the test causes
+// WriteSystemState/Rollback to write, since SystemStateRecoveryPath itself
+// is a fixed path outside of rootDir.
+func withTestStateSigningKey(t *testing.T) {
+	t.Helper()
+	orig := stateSigningKeyPath
+	stateSigningKeyPath = t.TempDir() + "/state-signing.key"
+	t.Cleanup(func() {
+		stateSigningKeyPath = orig
+		os.Remove(SystemStateRecoveryPath)
+	})
+}
+
+func testInstallFile() *InstallFile {
+	return &InstallFile{
+		Version:     CurrentInstallFileVersion,
+		ImageType:   ZAP,
+		Product:     "test-product",
+		UpdateType:  FullUpdate,
+		StorageType: AtomfsStorageType,
+		Signer:      "test-signer",
+	}
+}
+
+func testSysTargets() SysTargets {
+	return SysTargets{
+		{
+			Name:   "foo",
+			Source: "foo-manifest",
+			raw: &Target{
+				Name:        "foo",
+				Fullname:    "foo-manifest",
+				Version:     "1",
+				ServiceType: "container",
+			},
+		},
+	}
+}
+
+func TestWriteSystemStateRoundTrips(t *testing.T) {
+	withTestStateSigningKey(t)
+	rootDir := t.TempDir()
+
+	if err := WriteSystemState(rootDir, testInstallFile(), testSysTargets()); err != nil {
+		t.Fatalf("WriteSystemState: %v", err)
+	}
+
+	s, err := ReadSystemState(systemStatePath(rootDir))
+	if err != nil {
+		t.Fatalf("ReadSystemState: %v", err)
+	}
+	if s.Signature == "" {
+		t.Error("written state has no signature")
+	}
+	if len(s.Targets) != 1 || s.Targets[0].Name != "foo" {
+		t.Errorf("unexpected targets: %+v", s.Targets)
+	}
+}
+
+func TestReadSystemStateRejectsTamperedContent(t *testing.T) {
+	withTestStateSigningKey(t)
+	rootDir := t.TempDir()
+
+	if err := WriteSystemState(rootDir, testInstallFile(), testSysTargets()); err != nil {
+		t.Fatalf("WriteSystemState: %v", err)
+	}
+
+	path := systemStatePath(rootDir)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append(content, []byte("\nproduct: tampered\n")...)
+	if err := os.WriteFile(path, tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadSystemState(path); err == nil {
+		t.Error("ReadSystemState accepted a tampered state.yaml")
+	}
+}
+
+// fakeStorage is a minimal Storage that only records SetupTarget calls, so
+// Rollback can be tested without real mounts.
+type fakeStorage struct {
+	setUp []*Target
+}
+
+func (f *fakeStorage) Type() StorageType                          { return AtomfsStorageType }
+func (f *fakeStorage) Mount(t *Target, mp string) (func(), error) { return func() {}, nil }
+func (f *fakeStorage) MountWriteable(t *Target, mp string) (func(), error) {
+	return func() {}, nil
+}
+func (f *fakeStorage) MountedByHash(t *Target) (string, error)  { return "", nil }
+func (f *fakeStorage) TearDownTarget(name string) error         { return nil }
+func (f *fakeStorage) TargetMountdir(t *Target) (string, error) { return "", nil }
+func (f *fakeStorage) SetupTarget(t *Target) error {
+	f.setUp = append(f.setUp, t)
+	return nil
+}
+func (f *fakeStorage) ResetPersistence(t *Target) error { return nil }
+
+func TestWriteSystemStateThenRollback(t *testing.T) {
+	withTestStateSigningKey(t)
+	rootDir := t.TempDir()
+
+	if err := WriteSystemState(rootDir, testInstallFile(), testSysTargets()); err != nil {
+		t.Fatalf("first WriteSystemState: %v", err)
+	}
+
+	secondTargets := SysTargets{
+		{
+			Name:   "bar",
+			Source: "bar-manifest",
+			raw: &Target{
+				Name:     "bar",
+				Fullname: "bar-manifest",
+				Version:  "1",
+			},
+		},
+	}
+	secondInstall := testInstallFile()
+	secondInstall.Product = "test-product-v2"
+	if err := WriteSystemState(rootDir, secondInstall, secondTargets); err != nil {
+		t.Fatalf("second WriteSystemState: %v", err)
+	}
+
+	store := &fakeStorage{}
+	if err := Rollback(rootDir, store); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if len(store.setUp) != 1 || store.setUp[0].Name != "foo" {
+		t.Fatalf("Rollback re-activated %+v, want just target %q", store.setUp, "foo")
+	}
+
+	rolledBack, err := ReadSystemState(systemStatePath(rootDir))
+	if err != nil {
+		t.Fatalf("ReadSystemState after rollback: %v", err)
+	}
+	if rolledBack.Product != "test-product" {
+		t.Errorf("rolled-back product = %q, want %q", rolledBack.Product, "test-product")
+	}
+	if rolledBack.Signature == "" {
+		t.Error("rolled-back state has no signature")
+	}
+}
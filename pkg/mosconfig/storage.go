@@ -1,6 +1,7 @@
 package mosconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,9 +9,9 @@ import (
 	"strings"
 
 	"github.com/apex/log"
-	"golang.org/x/sys/unix"
 	"stackerbuild.io/stacker/pkg/atomfs"
 	"stackerbuild.io/stacker/pkg/mount"
+	"stackerbuild.io/stacker/pkg/puzzlefs"
 )
 
 type StorageType string
@@ -30,6 +31,66 @@ type Storage interface {
 	TearDownTarget(name string) error
 	TargetMountdir(t *Target) (string, error)
 	SetupTarget(t *Target) error
+
+	// ResetPersistence wipes the persistent upperdir/workdir (see
+	// Target.Persist) for a target, if any. The target must already be
+	// torn down.
+	//
+	// This is a library entry point only -- no "mos reset" subcommand
+	// calls it yet, since this tree has no cmd/ package. Whatever wires up
+	// mos's CLI will need to add one.
+	ResetPersistence(t *Target) error
+}
+
+// persistentDirs returns the upper/work directory pair to use for a
+// target's writeable overlay. If t.Persist names an explicit path, that
+// is used directly; otherwise the pair is derived deterministically from
+// t.Name under scratchPath so repeated boots of the same target agree on
+// where to find it.
+func persistentDirs(scratchPath string, t *Target) (upperdir, workdir string, err error) {
+	base := t.Persist.Path
+	if base == "" {
+		base = filepath.Join(scratchPath, "persistent", t.Name)
+	}
+
+	upperdir = filepath.Join(base, "upper")
+	workdir = filepath.Join(base, "work")
+
+	if err := EnsureDir(upperdir); err != nil {
+		return "", "", fmt.Errorf("Failed creating persistent upperdir %q: %w", upperdir, err)
+	}
+	if err := EnsureDir(workdir); err != nil {
+		return "", "", fmt.Errorf("Failed creating persistent workdir %q: %w", workdir, err)
+	}
+
+	return upperdir, workdir, nil
+}
+
+// resetPersistence wipes the persistent upper/workdir for a target rooted
+// at scratchPath, refusing to do so while the target is still mounted.
+func resetPersistence(scratchPath string, t *Target) error {
+	if t.Persist == nil || !t.Persist.Enabled {
+		return nil
+	}
+
+	mp := filepath.Join(scratchPath, "roots", t.Name)
+	mounted, err := IsMountpoint(mp)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	}
+	if mounted {
+		return fmt.Errorf("refusing to reset %q while it is still mounted; tear it down first", t.Name)
+	}
+
+	base := t.Persist.Path
+	if base == "" {
+		base = filepath.Join(scratchPath, "persistent", t.Name)
+	}
+	if err := os.RemoveAll(base); err != nil {
+		return fmt.Errorf("Failed wiping persistent state for %q: %w", t.Name, err)
+	}
+
+	return nil
 }
 
 func NewStorage(opts MosOptions) (Storage, error) {
@@ -37,9 +98,9 @@ func NewStorage(opts MosOptions) (Storage, error) {
 	var e error
 	switch opts.StorageType {
 	case AtomfsStorageType:
-		s, e = NewAtomfsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
+		s, e = NewAtomfsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites, opts.ZotURL)
 	case PuzzlefsStorageType:
-		return nil, fmt.Errorf("Not yet implemented")
+		s, e = NewPuzzlefsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
 	default:
 		return nil, fmt.Errorf("Unknown storage type requested")
 	}
@@ -51,13 +112,19 @@ type AtomfsStorage struct {
 	RootDir     string
 	zotPath     string
 	scratchPath string
+	// registryURL is zot's base HTTP(S) URL, e.g. "https://zot.example.com",
+	// used only by the LazyPull path (see lazypull.go) to range-fetch layer
+	// bytes directly from zot's OCI Distribution API instead of requiring
+	// them already present under zotPath. Empty if lazy pull isn't in use.
+	registryURL string
 }
 
-func NewAtomfsStorage(rootDir, zotPath, scratchPath string) (*AtomfsStorage, error) {
+func NewAtomfsStorage(rootDir, zotPath, scratchPath, registryURL string) (*AtomfsStorage, error) {
 	return &AtomfsStorage{
 		RootDir:     rootDir,
 		zotPath:     zotPath,
 		scratchPath: scratchPath,
+		registryURL: registryURL,
 	}, nil
 }
 
@@ -72,6 +139,14 @@ func (a *AtomfsStorage) metadataPath() string {
 }
 
 func (a *AtomfsStorage) Mount(t *Target, mountpoint string) (func(), error) {
+	if t.LazyPull {
+		// See lazypull.go: rather than atomfs.BuildMoleculeFromOCI
+		// requiring the whole layer already be pulled to zotPath, range-fetch
+		// it straight from zot over its estargz TOC, prioritizing
+		// PrefetchList.
+		return a.mountLazy(t, mountpoint)
+	}
+
 	if err := EnsureDir(mountpoint); err != nil {
 		return func() {}, fmt.Errorf("Failed creating mountpoint %q: %w", mountpoint, err)
 	}
@@ -105,51 +180,36 @@ func (a *AtomfsStorage) Mount(t *Target, mountpoint string) (func(), error) {
 }
 
 func (a *AtomfsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
-	ropath, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.Name))
-	if err != nil {
-		return func() {}, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
-	}
-
-	roCleanup, err := a.Mount(t, ropath)
-	if err != nil {
-		os.Remove(ropath)
-		return func() {}, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
-	}
-
-	workdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.Name))
-	if err != nil {
-		roCleanup()
-		os.Remove(ropath)
-		return func() {}, fmt.Errorf("Failed creating workdir: %w", err)
-	}
+	return mountWriteableOverlay(a.scratchPath, t, mountpoint, a.Mount)
+}
 
-	upperdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.Name))
-	if err != nil {
-		roCleanup()
-		os.Remove(ropath)
-		os.RemoveAll(workdir)
-		return func() {}, fmt.Errorf("Failed creating upperdir: %w", err)
+// mountContainer is the container-target mount strategy for atomfs: prefer
+// an idmapped mount of the readonly tree straight onto mp (no copy-up
+// upperdir, no extra disk use), falling back to the writeable overlay on
+// kernels/filesystems that can't do idmapped mounts yet.
+func (a *AtomfsStorage) mountContainer(t *Target, mp string) (func(), error) {
+	// An idmapped mount is a readonly bind of the underlying tree -- there
+	// is no upperdir at all, so it can't honor Persist's request for a
+	// writeable layer that survives TearDownTarget/SetupTarget cycles.
+	// Skip straight to the writeable overlay for persistent targets rather
+	// than silently handing the container a readonly root.
+	persistent := t.Persist != nil && t.Persist.Enabled
+
+	if !persistent {
+		if err := a.setupIdmapTarget(t, mp); err != nil {
+			if !errors.Is(err, errIdmapUnsupported) {
+				log.Warnf("idmapped mount for %q failed, falling back to writeable overlay: %s", t.Name, err)
+			}
+			return a.MountWriteable(t, mp)
+		}
+		return func() {}, nil
 	}
 
-	overlayArgs := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr", ropath, upperdir, workdir)
-	err = unix.Mount("overlayfs", mountpoint, "overlay", 0, overlayArgs)
-	if err != nil {
-		roCleanup()
-		os.RemoveAll(workdir)
-		os.RemoveAll(upperdir)
-		os.Remove(ropath)
-		return nil, err
-		return func() {}, fmt.Errorf("Failed mounting writeable overlay: %w", err)
-	}
-	cleanup := func() {
-		unix.Unmount(mountpoint, 0)
-		roCleanup()
-		os.RemoveAll(workdir)
-		os.RemoveAll(upperdir)
-		os.Remove(ropath)
-	}
+	return a.MountWriteable(t, mp)
+}
 
-	return cleanup, nil
+func (a *AtomfsStorage) ResetPersistence(t *Target) error {
+	return resetPersistence(a.scratchPath, t)
 }
 
 func getHashFromOverlay(mountinfo string, mountPoint string) (string, error) {
@@ -215,62 +275,164 @@ func (a *AtomfsStorage) MountedByHash(target *Target) (string, error) {
 }
 
 func (a *AtomfsStorage) SetupTarget(t *Target) error {
-	mp := filepath.Join(a.scratchPath, "roots", t.Name)
-	mounted, err := IsMountpoint(mp)
-	if err != nil {
-		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	return setupOverlayTarget(a.scratchPath, t, a.Mount, a.mountContainer)
+}
+
+// TargetMountdir returns the readonly-copy mountpoint under
+// $scratch-writes/roots/$target. A container service will want to set
+// lxc.rootfs.path = that, while an fs-only service will simply want to do
+// an overlay rw mount onto /mnt/atom/$target.
+func (a *AtomfsStorage) TargetMountdir(t *Target) (string, error) {
+	return targetMountdir(a.scratchPath, t)
+}
+
+func (a *AtomfsStorage) TearDownTarget(name string) error {
+	return tearDownOverlayTarget(a.scratchPath, name, "atomfs", func(mp string) error {
+		return safeUnmount(a.scratchPath, mp, 0)
+	})
+}
+
+type PuzzlefsStorage struct {
+	RootDir     string
+	zotPath     string
+	scratchPath string
+}
+
+func NewPuzzlefsStorage(rootDir, zotPath, scratchPath string) (*PuzzlefsStorage, error) {
+	return &PuzzlefsStorage{
+		RootDir:     rootDir,
+		zotPath:     zotPath,
+		scratchPath: scratchPath,
+	}, nil
+}
+
+func (p *PuzzlefsStorage) Type() StorageType {
+	return PuzzlefsStorageType
+}
+
+// The metadata path which we pass to 'stacker/puzzlefs' is the directory
+// 'puzzlefs' under *our* scratchdir.
+func (p *PuzzlefsStorage) metadataPath() string {
+	return filepath.Join(p.scratchPath, "puzzlefs")
+}
+
+func (p *PuzzlefsStorage) Mount(t *Target, mountpoint string) (func(), error) {
+	if err := EnsureDir(mountpoint); err != nil {
+		return func() {}, fmt.Errorf("Failed creating mountpoint %q: %w", mountpoint, err)
 	}
-	if mounted {
-		err := atomfs.Umount(mp)
-		if err != nil {
-			return err
-		}
+
+	opts := puzzlefs.MountOCIOpts{
+		OCIDir:       filepath.Join(p.zotPath, t.Fullname),
+		MetadataPath: p.metadataPath(),
+		Tag:          t.Version,
+		Target:       mountpoint,
 	}
 
-	err = EnsureDir(mp)
+	img, err := puzzlefs.BuildMoleculeFromOCI(opts)
 	if err != nil {
-		return fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
+		return func() {}, fmt.Errorf("Failed building puzzlefs molecule for %#v: %w", opts, err)
 	}
 
-	if t.ServiceType == "container" {
-		// For containers, we have to make this writeable to support
-		// uid shifting.  We can un-do this if/when we can use id mapped
-		// mounts.
-		// XXX TODO we should probably, therefore, umount this after
-		// every service stop.
-		_, err = a.MountWriteable(t, mp)
-	} else {
-		_, err = a.Mount(t, mp)
+	cleanup := func() {
+		err := puzzlefs.Umount(mountpoint)
+		if err != nil {
+			log.Warnf("unmounting %s failed: %s", mountpoint, err)
+		}
 	}
+	err = img.Mount(mountpoint)
 	if err != nil {
-		return fmt.Errorf("Failed mounting %s:%s to %q: %w", t.Name, t.Version, mp, err)
+		return cleanup, fmt.Errorf("Failed mounting molecule %#v: %w", img, err)
 	}
+	return cleanup, nil
+}
 
-	return nil
+func (p *PuzzlefsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
+	return mountWriteableOverlay(p.scratchPath, t, mountpoint, p.Mount)
 }
 
-// We mount a readonly copy of the fs under $scratch-writes/roots/$target.
-// A container service will want to set lxc.rootfs.path = that, while an
-// fs-only service will simply want to do an overlay rw mount onto
-// /mnt/atom/$target
-func (a *AtomfsStorage) TargetMountdir(t *Target) (string, error) {
-	return filepath.Join(a.scratchPath, "roots", t.Name), nil
+func (p *PuzzlefsStorage) ResetPersistence(t *Target) error {
+	return resetPersistence(p.scratchPath, t)
 }
 
-func (a *AtomfsStorage) TearDownTarget(name string) error {
-	log.Warnf("tearing down %q", name)
-	mp := filepath.Join(a.scratchPath, "roots", name)
-	mounted, err := IsMountpoint(mp)
+// puzzlefs mounts are a single fuse.puzzlefs mount rather than a stack of
+// overlay lowerdirs, so unlike atomix, the content hash isn't recoverable
+// from the overlay layer chain.  Instead it's encoded in the basename of
+// the mount source, which puzzlefs sets to the content-addressed manifest
+// it mounted.
+func getHashFromPuzzlefs(mountinfo string, mountPoint string) (string, error) {
+	mounts, err := mount.ParseMounts(mountinfo)
 	if err != nil {
-		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+		return "", err
 	}
-	if !mounted {
-		return nil
+
+	for _, m := range mounts {
+		if m.Target != mountPoint {
+			continue
+		}
+
+		if !strings.HasPrefix(m.FSType, "fuse.puzzlefs") {
+			continue
+		}
+
+		return filepath.Base(m.Source), nil
 	}
 
-	err = atomfs.Umount(mp)
-	if err != nil {
-		return fmt.Errorf("atomfs umount of %q failed: %w", mp, err)
+	return "", nil
+}
+
+func (p *PuzzlefsStorage) MountedByHash(target *Target) (string, error) {
+	switch target.ServiceType {
+	case "hostfs":
+		return getHashFromPuzzlefs("/proc/self/mountinfo", p.RootDir)
+	case "fs-only":
+		/* see SetupTargetRuntime() */
+		return getHashFromPuzzlefs("/proc/self/mountinfo", filepath.Join(p.RootDir, "mnt/atom", target.Name))
+	case "container":
+		// container services are lxc containers, which may or may not
+		// have their rootfs visible in this mount namespace. let's
+		// look at the specific mountinfo for the container just to be
+		// sure.  The container's root is the writeable overlay set up
+		// by MountWriteable, so the overlay detector still applies
+		// here regardless of which storage backend built the lowerdir.
+		out, rc := RunCommandWithRc("lxc-info", "-H", "-n", target.Name, "-s")
+		if rc != 0 {
+			/* if the service didn't previously exist, it's ok for lxc-ls to fail */
+			return "", nil
+		}
+		if strings.TrimSpace(string(out)) != "RUNNING" {
+			return "", nil
+		}
+		out, rc = RunCommandWithRc("lxc-info", "-H", "-n", target.Name, "-p")
+		if rc != 0 {
+			/* if the service didn't previously exist, it's ok for lxc-ls to fail */
+			return "", nil
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+		if err != nil {
+			return "", fmt.Errorf("couldn't get pid from %s: %w", strings.TrimSpace(string(out)), err)
+		}
+
+		return getHashFromOverlay(fmt.Sprintf("/proc/%d/mountinfo", pid), "/")
+	default:
+		return "", fmt.Errorf("couldn't determine mountpoint for %s (%s)", target.Name, target.ServiceType)
 	}
-	return err
+}
+
+func (p *PuzzlefsStorage) SetupTarget(t *Target) error {
+	// Containers need uid shifting, which on the puzzlefs backend still
+	// means the writeable-overlay hack: setupIdmapTarget (see chunk0-5) is
+	// only implemented against atomfs.BuildMoleculeFromOCI molecules, and
+	// puzzlefs doesn't have an equivalent entry point yet. So unlike
+	// AtomfsStorage, the container mount path here is just MountWriteable.
+	return setupOverlayTarget(p.scratchPath, t, p.Mount, p.MountWriteable)
+}
+
+func (p *PuzzlefsStorage) TargetMountdir(t *Target) (string, error) {
+	return targetMountdir(p.scratchPath, t)
+}
+
+func (p *PuzzlefsStorage) TearDownTarget(name string) error {
+	return tearDownOverlayTarget(p.scratchPath, name, "puzzlefs", func(mp string) error {
+		return safeUnmount(p.scratchPath, mp, 0)
+	})
 }
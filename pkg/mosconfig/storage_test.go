@@ -0,0 +1,102 @@
+package mosconfig
+
+import "testing"
+
+func TestNewStorageDispatchesToBothBackends(t *testing.T) {
+	cases := []struct {
+		storageType StorageType
+		want        StorageType
+	}{
+		{AtomfsStorageType, AtomfsStorageType},
+		{PuzzlefsStorageType, PuzzlefsStorageType},
+	}
+
+	for _, c := range cases {
+		opts := MosOptions{
+			StorageType:   c.storageType,
+			RootDir:       "/root",
+			StorageCache:  "/zot",
+			ScratchWrites: "/scratch",
+		}
+		s, err := NewStorage(opts)
+		if err != nil {
+			t.Fatalf("NewStorage(%s): %v", c.storageType, err)
+		}
+		if s.Type() != c.want {
+			t.Fatalf("Type() = %q, want %q", s.Type(), c.want)
+		}
+	}
+}
+
+func TestNewStorageUnknownType(t *testing.T) {
+	_, err := NewStorage(MosOptions{StorageType: StorageType("bogus")})
+	if err == nil {
+		t.Fatal("expected an error for an unknown storage type")
+	}
+}
+
+// TargetMountdir should agree across backends for the same target, since
+// both root their mountpoints at $scratch/roots/$name regardless of which
+// molecule format actually backs the mount.
+func TestTargetMountdirAgreesAcrossBackends(t *testing.T) {
+	target := &Target{Name: "foo"}
+
+	a, err := NewAtomfsStorage("/root", "/zot", "/scratch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPuzzlefsStorage("/root", "/zot", "/scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aDir, err := a.TargetMountdir(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pDir, err := p.TargetMountdir(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aDir != pDir {
+		t.Fatalf("atomfs and puzzlefs TargetMountdir disagree for the same target: %q vs %q", aDir, pDir)
+	}
+}
+
+func TestPersistentDirsDerivesFromName(t *testing.T) {
+	scratch := t.TempDir()
+	target := &Target{Name: "foo", Persist: &Persist{Enabled: true}}
+
+	upper, work, err := persistentDirs(scratch, target)
+	if err != nil {
+		t.Fatalf("persistentDirs: %v", err)
+	}
+
+	wantUpper := scratch + "/persistent/foo/upper"
+	wantWork := scratch + "/persistent/foo/work"
+	if upper != wantUpper {
+		t.Errorf("upperdir = %q, want %q", upper, wantUpper)
+	}
+	if work != wantWork {
+		t.Errorf("workdir = %q, want %q", work, wantWork)
+	}
+}
+
+func TestPersistentDirsExplicitPath(t *testing.T) {
+	scratch := t.TempDir()
+	explicit := t.TempDir()
+	target := &Target{Name: "foo", Persist: &Persist{Enabled: true, Path: explicit}}
+
+	upper, work, err := persistentDirs(scratch, target)
+	if err != nil {
+		t.Fatalf("persistentDirs: %v", err)
+	}
+
+	if upper != explicit+"/upper" {
+		t.Errorf("upperdir = %q, want %q", upper, explicit+"/upper")
+	}
+	if work != explicit+"/work" {
+		t.Errorf("workdir = %q, want %q", work, explicit+"/work")
+	}
+}
@@ -0,0 +1,257 @@
+package mosconfig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verifyInstallFile checks a detached signature over an install
+// manifest's raw bytes (exactly what NewInstallFile stores as
+// `original`), via readDetachedSignature. It returns the verified signer
+// identity (see certIdentity), or "" if AllowUnsigned let an unsigned file
+// through.
+func verifyInstallFile(path string, content []byte, opts MosOptions) (string, error) {
+	sig, certPEM, err := readDetachedSignature(path)
+	if err != nil {
+		if opts.AllowUnsigned {
+			return "", nil
+		}
+		return "", fmt.Errorf("no signature found for %q: %w", path, err)
+	}
+
+	identity, err := verifyBlobSignature(content, sig, certPEM, opts)
+	if err != nil {
+		return "", fmt.Errorf("signature verification failed for %q: %w", path, err)
+	}
+
+	return identity, nil
+}
+
+// cosignBundle mirrors the JSON sidecar cosign writes with `--bundle`
+// (cosign's LocalSignedPayload): the signature and signer cert bundled
+// into one file instead of split across ".sig"/".cert" siblings. Only the
+// fields readDetachedSignature needs are reproduced here.
+type cosignBundle struct {
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert"`
+}
+
+// readDetachedSignature locates and loads whatever detached-signature
+// sidecar basePath has: a "<basePath>.bundle" cosign bundle if one exists,
+// else "<basePath>.sig" + "<basePath>.cert". Real `cosign sign-blob`
+// output -- in either form -- base64-encodes the signature, so a ".sig"
+// sidecar is base64-decoded before use, falling back to its raw bytes if
+// that fails, to still accept a sidecar written directly as raw signature
+// bytes rather than by cosign itself.
+func readDetachedSignature(basePath string) ([]byte, []byte, error) {
+	bundlePath := basePath + ".bundle"
+	if content, err := os.ReadFile(bundlePath); err == nil {
+		var bundle cosignBundle
+		if err := json.Unmarshal(content, &bundle); err != nil {
+			return nil, nil, fmt.Errorf("Failed parsing bundle %q: %w", bundlePath, err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(bundle.Base64Signature)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed decoding signature in bundle %q: %w", bundlePath, err)
+		}
+		return sig, []byte(bundle.Cert), nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("Failed reading bundle %q: %w", bundlePath, err)
+	}
+
+	sigPath := basePath + ".sig"
+	certPath := basePath + ".cert"
+
+	rawSig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no signature found (tried %q and %q/%q)", bundlePath, sigPath, certPath)
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no signature found (tried %q and %q/%q)", bundlePath, sigPath, certPath)
+	}
+
+	sig := rawSig
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(rawSig))); err == nil {
+		sig = decoded
+	}
+	return sig, certPEM, nil
+}
+
+// verifyBlobSignature verifies sig over content using the public key in
+// certPEM, then verifies certPEM itself chains up to opts.FulcioRoots
+// (keyless/Fulcio-issued certs) or matches one of opts.TrustedKeys
+// (long-lived key pairs). It returns the identity recorded in the cert's
+// SAN, which for Fulcio-issued certs is the signer's verified OIDC
+// identity (email or URI), or the subject CommonName for a cert with
+// neither.
+func verifyBlobSignature(content, sig, certPEM []byte, opts MosOptions) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", fmt.Errorf("no PEM certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed parsing signer certificate: %w", err)
+	}
+
+	if err := verifyCertTrusted(cert, opts); err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(content)
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return "", fmt.Errorf("ECDSA signature does not verify")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return "", fmt.Errorf("RSA signature does not verify: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("unsupported signer key type %T", pub)
+	}
+
+	return certIdentity(cert), nil
+}
+
+// verifyCertTrusted checks the signer cert against either a configured
+// Fulcio root (keyless signing) or a static set of trusted keys,
+// whichever MosOptions provides. At least one must be configured and
+// succeed, since NewInstallFile otherwise fails closed.
+func verifyCertTrusted(cert *x509.Certificate, opts MosOptions) error {
+	if len(opts.FulcioRoots) > 0 {
+		roots := x509.NewCertPool()
+		for _, root := range opts.FulcioRoots {
+			if !roots.AppendCertsFromPEM(root) {
+				return fmt.Errorf("Failed loading a configured Fulcio root")
+			}
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}}); err == nil {
+			return nil
+		}
+	}
+
+	for _, trusted := range opts.TrustedKeys {
+		if eq, ok := trusted.(interface{ Equal(crypto.PublicKey) bool }); ok && eq.Equal(cert.PublicKey) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signer certificate matches neither a configured Fulcio root nor a trusted key")
+}
+
+// certIdentity pulls the signer identity out of a cert's SAN, preferring
+// the URIs cosign's Fulcio issues (e.g. a workflow identity), falling
+// back to an email SAN for user-held keys, and finally to the subject
+// CommonName when the cert has neither.
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// verifyManifestHashes confirms every target's ManifestHash matches the
+// digest zot actually has on disk for that target's tag, so a signed
+// InstallFile can't be paired with a manifest_hash that doesn't describe
+// what will actually get mounted. Cosign attestations alongside the
+// manifest, if present, are verified the same way as the install
+// manifest's own signature.
+func verifyManifestHashes(af *InstallFile, opts MosOptions) error {
+	for _, t := range af.Targets {
+		ociDir := filepath.Join(opts.StorageCache, t.Fullname)
+
+		digest, err := ociManifestDigest(ociDir, t.Version)
+		if err != nil {
+			if opts.AllowUnsigned {
+				continue
+			}
+			return fmt.Errorf("Failed resolving manifest digest for target %q: %w", t.Name, err)
+		}
+
+		if digest != t.ManifestHash {
+			return fmt.Errorf("target %q: manifest_hash %q does not match resolved manifest digest %q", t.Name, t.ManifestHash, digest)
+		}
+
+		if err := verifyManifestAttestation(ociDir, digest, opts); err != nil && !opts.AllowUnsigned {
+			return fmt.Errorf("target %q: %w", t.Name, err)
+		}
+	}
+
+	return nil
+}
+
+type ociIndex struct {
+	Manifests []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// ociManifestDigest resolves tag to the digest of its manifest blob by
+// reading the OCI image layout's index.json directly -- zot's on-disk
+// layout is just that, so no registry round trip is needed.
+func ociManifestDigest(ociDir, tag string) (string, error) {
+	indexPath := filepath.Join(ociDir, "index.json")
+	content, err := os.ReadFile(indexPath)
+	if err != nil {
+		return "", err
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return "", fmt.Errorf("Failed parsing %q: %w", indexPath, err)
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations["org.opencontainers.image.ref.name"] == tag {
+			return strings.TrimPrefix(m.Digest, "sha256:"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no manifest for tag %q in %q", tag, indexPath)
+}
+
+// verifyManifestAttestation verifies a cosign attestation for digest if
+// zot has one stored (as "<ociDir>/blobs/sha256/<digest>.att", with its
+// signature in a ".bundle" or ".sig"/".cert" sidecar next to it, mirroring
+// the install manifest's own sidecar files -- see readDetachedSignature).
+// It's not an error for one to be absent -- not every manifest is attested
+// -- only for one to be present and fail to verify.
+func verifyManifestAttestation(ociDir, digest string, opts MosOptions) error {
+	base := filepath.Join(ociDir, "blobs", "sha256", digest+".att")
+	content, err := os.ReadFile(base)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed reading attestation for %s: %w", digest, err)
+	}
+
+	sig, certPEM, err := readDetachedSignature(base)
+	if err != nil {
+		return fmt.Errorf("attestation for %s has no signature: %w", digest, err)
+	}
+
+	if _, err := verifyBlobSignature(content, sig, certPEM, opts); err != nil {
+		return fmt.Errorf("attestation for %s does not verify: %w", digest, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package mosconfig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genTestCert returns a self-signed leaf certificate (PEM-encoded) and the
+// private key that signs for it, suitable as the sidecar ".cert"/signer
+// key pair verifyBlobSignature expects.
+func genTestCert(t *testing.T) (certPEM []byte, priv *ecdsa.PrivateKey) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), priv
+}
+
+func signDigest(t *testing.T, priv *ecdsa.PrivateKey, content []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(content)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestVerifyBlobSignatureAcceptsValidSignature(t *testing.T) {
+	content := []byte("install manifest content")
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, content)
+
+	opts := MosOptions{TrustedKeys: []crypto.PublicKey{&priv.PublicKey}}
+	identity, err := verifyBlobSignature(content, sig, certPEM, opts)
+	if err != nil {
+		t.Fatalf("verifyBlobSignature: %v", err)
+	}
+	if identity != "test-signer" {
+		t.Errorf("identity = %q, want %q", identity, "test-signer")
+	}
+}
+
+func TestVerifyBlobSignatureRejectsTamperedContent(t *testing.T) {
+	content := []byte("install manifest content")
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, content)
+
+	opts := MosOptions{TrustedKeys: []crypto.PublicKey{&priv.PublicKey}}
+	tampered := []byte("install manifest content, but different")
+	if _, err := verifyBlobSignature(tampered, sig, certPEM, opts); err == nil {
+		t.Error("verifyBlobSignature accepted a signature over different content")
+	}
+}
+
+func TestVerifyBlobSignatureRejectsWrongCert(t *testing.T) {
+	content := []byte("install manifest content")
+	_, priv := genTestCert(t)
+	sig := signDigest(t, priv, content)
+
+	otherCertPEM, otherPriv := genTestCert(t)
+	opts := MosOptions{TrustedKeys: []crypto.PublicKey{&otherPriv.PublicKey}}
+	if _, err := verifyBlobSignature(content, sig, otherCertPEM, opts); err == nil {
+		t.Error("verifyBlobSignature accepted a signature against the wrong cert")
+	}
+}
+
+func TestVerifyBlobSignatureRejectsUntrustedKey(t *testing.T) {
+	content := []byte("install manifest content")
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, content)
+
+	// No FulcioRoots, no matching TrustedKeys configured at all.
+	opts := MosOptions{}
+	if _, err := verifyBlobSignature(content, sig, certPEM, opts); err == nil {
+		t.Error("verifyBlobSignature accepted a cert that matches no trusted root or key")
+	}
+}
+
+func TestReadDetachedSignaturePrefersBundle(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "manifest")
+
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, []byte("whatever"))
+
+	bundle := cosignBundle{
+		Base64Signature: base64.StdEncoding.EncodeToString(sig),
+		Cert:            string(certPEM),
+	}
+	content, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".bundle", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotSig, gotCert, err := readDetachedSignature(base)
+	if err != nil {
+		t.Fatalf("readDetachedSignature: %v", err)
+	}
+	if string(gotSig) != string(sig) {
+		t.Errorf("sig = %x, want %x", gotSig, sig)
+	}
+	if string(gotCert) != string(certPEM) {
+		t.Errorf("cert = %q, want %q", gotCert, certPEM)
+	}
+}
+
+func TestReadDetachedSignatureBase64Sidecar(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "manifest")
+
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, []byte("whatever"))
+
+	if err := os.WriteFile(base+".sig", []byte(base64.StdEncoding.EncodeToString(sig)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".cert", certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotSig, _, err := readDetachedSignature(base)
+	if err != nil {
+		t.Fatalf("readDetachedSignature: %v", err)
+	}
+	if string(gotSig) != string(sig) {
+		t.Errorf("sig = %x, want %x", gotSig, sig)
+	}
+}
+
+func TestReadDetachedSignatureRawSidecarFallback(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "manifest")
+
+	certPEM, priv := genTestCert(t)
+	sig := signDigest(t, priv, []byte("whatever"))
+
+	// Raw ASN.1 signature bytes, not base64-encoded -- readDetachedSignature
+	// should fall back to using them as-is when base64 decoding fails.
+	if err := os.WriteFile(base+".sig", sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".cert", certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotSig, _, err := readDetachedSignature(base)
+	if err != nil {
+		t.Fatalf("readDetachedSignature: %v", err)
+	}
+	if string(gotSig) != string(sig) {
+		t.Errorf("sig = %x, want %x", gotSig, sig)
+	}
+}